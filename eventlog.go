@@ -0,0 +1,92 @@
+package main
+
+import (
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventSeverity identifies which Windows Event Log category a message is
+// reported under.
+type eventSeverity int
+
+const (
+	evSevInfo eventSeverity = iota
+	evSevWarning
+	evSevError
+)
+
+// Event IDs used for messages winsvcwrap writes to the Event Log. The
+// source is registered against the stock EventCreate.exe message file (see
+// installEventLogSource), so EventViewer renders these using its generic
+// "the description for Event ID ... could not be found... message
+// resource(s)... text: <msg>" wrapper rather than a custom per-severity
+// format string; the messages themselves are still the full text passed to
+// Report.
+const (
+	eventIDInfo  uint32 = 1
+	eventIDWarn  uint32 = 2
+	eventIDError uint32 = 3
+)
+
+// eventlogHandle wraps an open Event Log handle and maps winsvcwrap's
+// internal severities onto the appropriate eventlog.Log method and event
+// ID.
+type eventlogHandle struct {
+	l *eventlog.Log
+}
+
+func eventLogSourceName(cfg *Config) string {
+	if cfg.EventLogSource != "" {
+		return cfg.EventLogSource
+	}
+	return serviceName(cfg)
+}
+
+// openEventLog opens the Event Log source for writing. The source must
+// already have been registered via the install-eventlog subcommand.
+func openEventLog(cfg *Config) (*eventlogHandle, error) {
+	l, err := eventlog.Open(eventLogSourceName(cfg))
+	if err != nil {
+		return nil, err
+	}
+	return &eventlogHandle{l: l}, nil
+}
+
+func (h *eventlogHandle) Report(sev eventSeverity, msg string) error {
+	switch sev {
+	case evSevError:
+		return h.l.Error(eventIDError, msg)
+	case evSevWarning:
+		return h.l.Warning(eventIDWarn, msg)
+	default:
+		return h.l.Info(eventIDInfo, msg)
+	}
+}
+
+func (h *eventlogHandle) Close() error {
+	return h.l.Close()
+}
+
+// installEventLogSource registers an Event Log source so EventViewer can
+// display messages winsvcwrap writes via openEventLog. It uses
+// EventCreate.exe's own message file (the same one "eventcreate.exe"
+// uses), since winsvcwrap does not ship a custom message-table resource.
+func installEventLogSource(cfg *Config) error {
+	name := eventLogSourceName(cfg)
+	err := eventlog.InstallAsEventCreate(name, eventlog.Info|eventlog.Warning|eventlog.Error)
+	if err != nil {
+		return err
+	}
+
+	log.Noticef("event log source %q installed", name)
+	return nil
+}
+
+func uninstallEventLogSource(cfg *Config) error {
+	name := eventLogSourceName(cfg)
+	if err := eventlog.Remove(name); err != nil {
+		return err
+	}
+
+	log.Noticef("event log source %q removed", name)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// healthCheckConfigured reports whether any health probe is configured.
+func healthCheckConfigured(cfg *Config) bool {
+	return cfg.HealthTCP != "" || cfg.HealthHTTP != "" || cfg.HealthExec != ""
+}
+
+// healthLoop periodically probes the supervised process's health and,
+// after HealthFailureThreshold consecutive failures, asks ctlLoop to
+// restart it. It runs for the lifetime of the Supervisor, independently
+// of individual spawn/restart cycles.
+func (sup *Supervisor) healthLoop() {
+	interval := sup.cfg.HealthInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	threshold := sup.cfg.HealthFailureThreshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for range ticker.C {
+		err := sup.probeHealth()
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		log.Noticee(err, fmt.Sprintf("health check failed (%d/%d)", failures, threshold))
+		if failures >= threshold {
+			failures = 0
+			sup.ctlChan <- ctlEvent{Type: ctlHealthFailed, Error: err}
+		}
+	}
+}
+
+// probeHealth runs whichever health checks are configured and returns the
+// first error encountered, if any.
+func (sup *Supervisor) probeHealth() error {
+	if sup.cfg.HealthTCP != "" {
+		conn, err := net.DialTimeout("tcp", sup.cfg.HealthTCP, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	if sup.cfg.HealthHTTP != "" {
+		client := http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(sup.cfg.HealthHTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("health check GET %s returned status %d", sup.cfg.HealthHTTP, resp.StatusCode)
+		}
+	}
+
+	if sup.cfg.HealthExec != "" {
+		if err := exec.Command(sup.cfg.HealthExec).Run(); err != nil {
+			return fmt.Errorf("health check command failed: %w", err)
+		}
+	}
+
+	return nil
+}
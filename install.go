@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceCommand dispatches the install, uninstall, start and stop
+// subcommands, which manage winsvcwrap's own registration with the
+// Windows Service Control Manager.
+func serviceCommand(cmd string, cfg *Config) error {
+	switch cmd {
+	case "install":
+		return installService(cfg)
+	case "uninstall":
+		return uninstallService(cfg)
+	case "start":
+		return startService(cfg)
+	case "stop":
+		return stopService(cfg)
+	case "install-eventlog":
+		return installEventLogSource(cfg)
+	case "uninstall-eventlog":
+		return uninstallEventLogSource(cfg)
+	default:
+		return fmt.Errorf("unknown service command %q", cmd)
+	}
+}
+
+func serviceName(cfg *Config) string {
+	if cfg.ServiceName != "" {
+		return cfg.ServiceName
+	}
+	return "winsvcwrap"
+}
+
+// binaryPathName constructs the command line the SCM will use to start
+// the service: the path to this executable together with the flags
+// needed to reproduce cfg.
+func binaryPathName(cfg *Config) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{quoteArg(exe)}
+	if cfg.Run != "" {
+		args = append(args, "--run="+quoteArg(cfg.Run))
+	}
+	for _, a := range cfg.Arg {
+		args = append(args, "--arg="+quoteArg(a))
+	}
+	if cfg.CWD != "" {
+		args = append(args, "--cwd="+quoteArg(cfg.CWD))
+	}
+	if cfg.CaptureStdOut {
+		args = append(args, "--capturestdout=1")
+	}
+	if cfg.CaptureStdErr {
+		args = append(args, "--capturestderr=1")
+	}
+	if cfg.ServiceName != "" {
+		args = append(args, "--servicename="+quoteArg(cfg.ServiceName))
+	}
+	if cfg.EventLog {
+		args = append(args, "--eventlog=1")
+	}
+	if cfg.EventLogSource != "" {
+		args = append(args, "--eventlogsource="+quoteArg(cfg.EventLogSource))
+	}
+	if cfg.PanicLogDir != "" {
+		args = append(args, "--paniclogdir="+quoteArg(cfg.PanicLogDir))
+	}
+	if cfg.PanicLogKeep != 0 {
+		args = append(args, fmt.Sprintf("--paniclogkeep=%d", cfg.PanicLogKeep))
+	}
+	if cfg.StopSignal != "" {
+		args = append(args, "--stopsignal="+quoteArg(cfg.StopSignal))
+	}
+	if cfg.StopTimeout != 0 {
+		args = append(args, "--stoptimeout="+quoteArg(cfg.StopTimeout.String()))
+	}
+	if cfg.RestartPolicy != "" {
+		args = append(args, "--restartpolicy="+quoteArg(cfg.RestartPolicy))
+	}
+	// Unlike the other numeric/duration flags, 0 is not an "unset" sentinel
+	// here: restartsExhausted (restart.go) treats 0 as a real "never restart"
+	// setting distinct from the -1 "unlimited" default, so this must always
+	// be emitted rather than only when non-zero.
+	args = append(args, fmt.Sprintf("--maxrestarts=%d", cfg.MaxRestarts))
+	if cfg.RestartBackoffInitial != 0 {
+		args = append(args, "--restartbackoffinitial="+quoteArg(cfg.RestartBackoffInitial.String()))
+	}
+	if cfg.RestartBackoffMax != 0 {
+		args = append(args, "--restartbackoffmax="+quoteArg(cfg.RestartBackoffMax.String()))
+	}
+	if cfg.HealthySince != 0 {
+		args = append(args, "--healthysince="+quoteArg(cfg.HealthySince.String()))
+	}
+	if cfg.HealthTCP != "" {
+		args = append(args, "--healthtcp="+quoteArg(cfg.HealthTCP))
+	}
+	if cfg.HealthHTTP != "" {
+		args = append(args, "--healthhttp="+quoteArg(cfg.HealthHTTP))
+	}
+	if cfg.HealthExec != "" {
+		args = append(args, "--healthexec="+quoteArg(cfg.HealthExec))
+	}
+	if cfg.HealthInterval != 0 {
+		args = append(args, "--healthinterval="+quoteArg(cfg.HealthInterval.String()))
+	}
+	if cfg.HealthFailureThreshold != 0 {
+		args = append(args, fmt.Sprintf("--healthfailurethreshold=%d", cfg.HealthFailureThreshold))
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+// quoteArg escapes s for inclusion in the command line the SCM passes to
+// CreateProcess, following the same backslash-doubling/quoting rule as
+// CommandLineToArgvW (and os/exec on Windows) expects, so that values like
+// `C:\Program Files\MyApp\` round-trip correctly even though they end in a
+// backslash immediately before what would otherwise be the closing quote.
+func quoteArg(s string) string {
+	return syscall.EscapeArg(s)
+}
+
+func installService(cfg *Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	name := serviceName(cfg)
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %q is already installed", name)
+	}
+
+	exepath, err := binaryPathName(cfg)
+	if err != nil {
+		return err
+	}
+
+	s, err := m.CreateService(name, exepath, mgr.Config{
+		DisplayName: name,
+		Description: "Windows service hosting adapter (winsvcwrap)",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := configureRecoveryActions(s, cfg); err != nil {
+		log.Errore(err, "failed to configure service recovery actions, continuing...")
+	}
+
+	log.Noticef("service %q installed", name)
+	return nil
+}
+
+func uninstallService(cfg *Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	name := serviceName(cfg)
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %q is not installed: %v", name, err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return err
+	}
+
+	log.Noticef("service %q uninstalled", name)
+	return nil
+}
+
+func startService(cfg *Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	name := serviceName(cfg)
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %q is not installed: %v", name, err)
+	}
+	defer s.Close()
+
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	log.Noticef("service %q started", name)
+	return nil
+}
+
+func stopService(cfg *Config) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	name := serviceName(cfg)
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %q is not installed: %v", name, err)
+	}
+	defer s.Close()
+
+	if _, err := s.Control(svc.Stop); err != nil {
+		return err
+	}
+
+	log.Noticef("service %q stop requested", name)
+	return nil
+}
+
+// configureRecoveryActions programs the SCM, via
+// SERVICE_CONFIG_FAILURE_ACTIONS, to automatically restart the wrapper
+// (and thus its supervised child) after a crash.
+func configureRecoveryActions(s *mgr.Service, cfg *Config) error {
+	delay := cfg.RestartDelay
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	reset := cfg.ResetPeriod
+	if reset <= 0 {
+		reset = 24 * time.Hour
+	}
+
+	actions := []windows.SC_ACTION{
+		{Type: windows.SC_ACTION_RESTART, Delay: uint32(delay / time.Millisecond)},
+		{Type: windows.SC_ACTION_RESTART, Delay: uint32(delay / time.Millisecond)},
+		{Type: windows.SC_ACTION_RESTART, Delay: uint32(delay / time.Millisecond)},
+	}
+
+	failureActions := windows.SERVICE_FAILURE_ACTIONS{
+		ResetPeriod:  uint32(reset / time.Second),
+		ActionsCount: uint32(len(actions)),
+		Actions:      &actions[0],
+	}
+
+	return windows.ChangeServiceConfig2(
+		s.Handle,
+		windows.SERVICE_CONFIG_FAILURE_ACTIONS,
+		(*byte)(unsafe.Pointer(&failureActions)),
+	)
+}
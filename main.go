@@ -3,8 +3,10 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/hlandau/dexlogconfig"
 	"github.com/hlandau/xlog"
+	"golang.org/x/sys/windows/svc"
 	"gopkg.in/hlandau/easyconfig.v1"
 	"gopkg.in/hlandau/service.v2"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 )
 
 var log, Log = xlog.New("winsvcwrap")
@@ -21,11 +24,32 @@ var logStdErr, LogStdErr = xlog.NewUnder("stderr", Log)
 
 // Configuration for the daemon.
 type Config struct {
-	Run           string   `usage:"Path to service executable to spawn" default:""`
-	Arg           []string `usage:"Argument to pass to service executable (specify multiple times)" default:""`
-	CWD           string   `usage:"Working directory to use for spawned service" default:""`
-	CaptureStdOut bool     `usage:"Capture stdout of supervised process and send to xlog?" default:""`
-	CaptureStdErr bool     `usage:"Capture stderr of supervised process and send to xlog?" default:""`
+	Run            string        `usage:"Path to service executable to spawn" default:""`
+	Arg            []string      `usage:"Argument to pass to service executable (specify multiple times)" default:""`
+	CWD            string        `usage:"Working directory to use for spawned service" default:""`
+	CaptureStdOut  bool          `usage:"Capture stdout of supervised process and send to xlog?" default:""`
+	CaptureStdErr  bool          `usage:"Capture stderr of supervised process and send to xlog?" default:""`
+	ServiceName    string        `usage:"Name under which winsvcwrap registers itself with the SCM" default:"winsvcwrap"`
+	RestartDelay   time.Duration `usage:"Delay before the SCM restarts winsvcwrap after a crash" default:"5s"`
+	ResetPeriod    time.Duration `usage:"Period of uptime after which the SCM failure count resets" default:"24h"`
+	EventLog       bool          `usage:"Also send captured stdout/stderr and wrapper diagnostics to the Windows Event Log?" default:""`
+	EventLogSource string        `usage:"Event Log source to log under (defaults to ServiceName)" default:""`
+	PanicLogDir    string        `usage:"Directory to store rotating panic/crash logs in (default %ProgramData%\\winsvcwrap\\<service name>)" default:""`
+	PanicLogKeep   int           `usage:"Number of rotated panic log files to retain" default:"10"`
+	StopSignal     string        `usage:"Signal used to request graceful shutdown: ctrl-break, ctrl-c, wm-close or kill" default:"ctrl-break"`
+	StopTimeout    time.Duration `usage:"How long to wait for the supervised process to exit gracefully before killing it" default:"30s"`
+
+	RestartPolicy         string        `usage:"When to restart the supervised process in-process: never, on-failure or always" default:"never"`
+	MaxRestarts           int           `usage:"Maximum number of in-process restarts before giving up and exiting (-1 for unlimited)" default:"-1"`
+	RestartBackoffInitial time.Duration `usage:"Initial delay before restarting the supervised process" default:"1s"`
+	RestartBackoffMax     time.Duration `usage:"Maximum delay between restart attempts (doubles after each failure)" default:"30s"`
+	HealthySince          time.Duration `usage:"How long the process must stay up before the restart backoff resets" default:"60s"`
+
+	HealthTCP              string        `usage:"host:port to dial as a TCP health check" default:""`
+	HealthHTTP             string        `usage:"URL to GET as an HTTP health check, expecting a 2xx response" default:""`
+	HealthExec             string        `usage:"Command to run as a health check probe; a nonzero exit means unhealthy" default:""`
+	HealthInterval         time.Duration `usage:"Interval between health check probes" default:"10s"`
+	HealthFailureThreshold int           `usage:"Consecutive health check failures before the process is restarted" default:"3"`
 }
 
 type ctlEventType int
@@ -33,6 +57,9 @@ type ctlEventType int
 const (
 	ctlTerminated ctlEventType = iota
 	ctlStopReq
+	ctlStopTimeout
+	ctlRestartTimer
+	ctlHealthFailed
 )
 
 type ctlEvent struct {
@@ -49,6 +76,12 @@ type Supervisor struct {
 	logWriterOut   *logWriter
 	logWriterErr   *logWriter
 	logWriterMutex sync.Mutex
+	elog           *eventlogHandle
+	panicFile      *os.File
+	stopTimer      *time.Timer
+	restartCount   int
+	currentBackoff time.Duration
+	lastSpawnAt    time.Time
 }
 
 func New(cfg *Config) (*Supervisor, error) {
@@ -64,17 +97,60 @@ func New(cfg *Config) (*Supervisor, error) {
 func (sup *Supervisor) Start() error {
 	log.Debugf("starting supervisor...")
 
+	if sup.cfg.EventLog {
+		elog, err := openEventLog(&sup.cfg)
+		if err != nil {
+			log.Errore(err, "could not open event log, continuing without it")
+		} else {
+			sup.elog = elog
+		}
+	}
+
+	if err := sup.spawn(); err != nil {
+		return err
+	}
+
+	go sup.ctlLoop()
+
+	if healthCheckConfigured(&sup.cfg) {
+		go sup.healthLoop()
+	}
+
+	return nil
+}
+
+// spawn builds and starts the supervised process and re-hooks the log
+// writers onto it. It is called once by Start and again by ctlLoop for
+// every in-process restart (see RestartPolicy).
+func (sup *Supervisor) spawn() error {
 	sup.cmd = exec.Command(sup.cfg.Run, sup.cfg.Arg...)
 	sup.cmd.Dir = sup.cfg.CWD
+	// Run the child in its own process group so a graceful stop signal
+	// (ctrl-break/ctrl-c) can be targeted at it alone via
+	// GenerateConsoleCtrlEvent without also being delivered to winsvcwrap.
+	sup.cmd.SysProcAttr = newChildSysProcAttr()
 	if sup.cfg.CaptureStdOut {
 		logStdOut.Debugf("stdout capture is enabled")
-		sup.logWriterOut = newLogWriter(sup, logStdOut)
+		sup.logWriterOut = newLogWriter(sup, logStdOut, sup.elog, evSevInfo)
 		sup.cmd.Stdout = sup.logWriterOut
 	}
 	if sup.cfg.CaptureStdErr {
 		logStdOut.Debugf("stderr capture is enabled")
-		sup.logWriterErr = newLogWriter(sup, logStdErr)
-		sup.cmd.Stderr = sup.logWriterErr
+		sup.logWriterErr = newLogWriter(sup, logStdErr, sup.elog, evSevWarning)
+
+		if sup.panicFile == nil {
+			panicFile, err := openPanicFile(&sup.cfg)
+			if err != nil {
+				log.Errore(err, "could not open panic log file, continuing without it")
+			} else {
+				sup.panicFile = panicFile
+			}
+		}
+		if sup.panicFile != nil {
+			sup.cmd.Stderr = io.MultiWriter(sup.logWriterErr, sup.panicFile)
+		} else {
+			sup.cmd.Stderr = sup.logWriterErr
+		}
 	}
 
 	err := sup.cmd.Start()
@@ -83,7 +159,7 @@ func (sup *Supervisor) Start() error {
 		return err
 	}
 
-	go sup.ctlLoop()
+	sup.lastSpawnAt = time.Now()
 	go sup.waitTerm()
 
 	return nil
@@ -96,15 +172,40 @@ func (sup *Supervisor) ctlLoop() {
 		switch ev.Type {
 		case ctlTerminated:
 			if pendingStopReq != nil {
+				if sup.stopTimer != nil {
+					sup.stopTimer.Stop()
+				}
 				pendingStopReq <- ev.Error
+				pendingStopReq = nil
 			} else {
 				if ev.Error != nil {
 					log.Criticale(ev.Error, "service supervised by winsvcwrap exited unexpectedly with error")
+					sup.reportEvent(evSevError, fmt.Sprintf("supervised process exited unexpectedly: %v", ev.Error))
 				} else {
 					log.Critical("service supervised by winsvcwrap exited unexpectedly without error")
+					sup.reportEvent(evSevError, "supervised process exited unexpectedly without error")
+				}
+				if sup.panicFile != nil {
+					sup.panicFile.Close()
+					sup.panicFile = nil
+					if err := rotatePanicFile(&sup.cfg); err != nil {
+						log.Errore(err, "failed to rotate panic log file")
+					}
+				}
+
+				if shouldRestart(&sup.cfg, ev.Error) && !restartsExhausted(&sup.cfg, sup.restartCount) {
+					backoff := sup.nextBackoff()
+					log.Noticef("restarting supervised process in %s (attempt %d)", backoff, sup.restartCount)
+					sup.reportEvent(evSevWarning, fmt.Sprintf("restarting supervised process in %s (attempt %d)", backoff, sup.restartCount))
+					time.AfterFunc(backoff, func() {
+						sup.ctlChan <- ctlEvent{Type: ctlRestartTimer}
+					})
+					continue
 				}
-				// This should not happen, so just exit with error so the Windows service
-				// manager will restart us.
+
+				// Either RestartPolicy says not to restart, or we've exhausted
+				// MaxRestarts, so exit with error and let the Windows service
+				// manager's own recovery actions take over.
 				os.Exit(3)
 			}
 		case ctlStopReq:
@@ -113,8 +214,46 @@ func (sup *Supervisor) ctlLoop() {
 			}
 			pendingStopReq = ev.DoneChan
 
-			err := sup.cmd.Process.Kill()
-			log.Errore(err, "failed to kill supervised process, continuing...")
+			log.Debugf("requesting graceful shutdown of supervised process via %s", sup.cfg.StopSignal)
+			if err := sendStopSignal(sup); err != nil {
+				log.Errore(err, "failed to send graceful stop signal, killing supervised process")
+				if err := sup.cmd.Process.Kill(); err != nil {
+					log.Errore(err, "failed to kill supervised process, continuing...")
+				}
+				continue
+			}
+
+			timeout := stopTimeout(&sup.cfg)
+			sup.stopTimer = time.AfterFunc(timeout, func() {
+				sup.ctlChan <- ctlEvent{Type: ctlStopTimeout}
+			})
+
+		case ctlStopTimeout:
+			if pendingStopReq == nil {
+				// Already stopped gracefully in time; nothing to do.
+				continue
+			}
+			log.Notice("supervised process did not exit within StopTimeout, killing it")
+			if err := sup.cmd.Process.Kill(); err != nil {
+				log.Errore(err, "failed to kill supervised process, continuing...")
+			}
+
+		case ctlRestartTimer:
+			log.Debugf("restart backoff elapsed, respawning supervised process")
+			if err := sup.spawn(); err != nil {
+				log.Criticale(err, "failed to respawn supervised process, giving up")
+				os.Exit(3)
+			}
+
+		case ctlHealthFailed:
+			log.Noticee(ev.Error, "health check failed too many times, restarting supervised process")
+			sup.reportEvent(evSevWarning, fmt.Sprintf("health check failed too many times, restarting: %v", ev.Error))
+			// Killing the process here just causes the usual waitTerm/ctlTerminated
+			// path to fire, which applies RestartPolicy/backoff uniformly whether
+			// the process crashed on its own or was deemed unhealthy.
+			if err := sup.cmd.Process.Kill(); err != nil {
+				log.Errore(err, "failed to kill unhealthy supervised process, continuing...")
+			}
 		}
 	}
 }
@@ -129,8 +268,28 @@ func (sup *Supervisor) waitTerm() {
 	if sup.logWriterErr != nil {
 		sup.logWriterErr.Flush()
 	}
+	// sup.elog, if open, is intentionally left open here: waitTerm fires on
+	// every spawn when RestartPolicy triggers an in-process restart, and the
+	// event log handle's lifetime is winsvcwrap's own, not the child's.
 }
 
+// reportEvent emits a wrapper-level diagnostic to the event log, if one is
+// open. It is a no-op (besides the message being lost) if EventLog is not
+// enabled.
+func (sup *Supervisor) reportEvent(sev eventSeverity, msg string) {
+	if sup.elog == nil {
+		return
+	}
+	if err := sup.elog.Report(sev, msg); err != nil {
+		log.Errore(err, "failed to write to event log")
+	}
+}
+
+// Stop requests a graceful shutdown of the supervised process and blocks
+// until it exits or is killed after StopTimeout. It is called in response
+// to an SCM stop request, either by winSvcHandler.stop (which keeps the
+// SCM informed of progress via WaitHint/CheckPoint while this blocks) or
+// by service.v2 when running interactively.
 func (sup *Supervisor) Stop() error {
 	log.Debugf("processing request to stop supervised process...")
 	doneCh := make(chan error)
@@ -145,16 +304,20 @@ func (sup *Supervisor) Stop() error {
 }
 
 type logWriter struct {
-	sup    *Supervisor
-	Logger xlog.Logger
-	buf    *bytes.Buffer
+	sup     *Supervisor
+	Logger  xlog.Logger
+	buf     *bytes.Buffer
+	elog    *eventlogHandle
+	elogSev eventSeverity
 }
 
-func newLogWriter(sup *Supervisor, logger xlog.Logger) *logWriter {
+func newLogWriter(sup *Supervisor, logger xlog.Logger, elog *eventlogHandle, elogSev eventSeverity) *logWriter {
 	lw := &logWriter{
-		sup:    sup,
-		Logger: logger,
-		buf:    bytes.NewBuffer(nil),
+		sup:     sup,
+		Logger:  logger,
+		buf:     bytes.NewBuffer(nil),
+		elog:    elog,
+		elogSev: elogSev,
 	}
 	return lw
 }
@@ -170,7 +333,13 @@ func (lw *logWriter) Write(b []byte) (int, error) {
 			break
 		}
 
-		lw.Logger.Info(strings.TrimRight(L, "\r\n"))
+		line := strings.TrimRight(L, "\r\n")
+		lw.Logger.Info(line)
+		if lw.elog != nil {
+			if err := lw.elog.Report(lw.elogSev, line); err != nil {
+				log.Errore(err, "failed to write captured output to event log")
+			}
+		}
 	}
 
 	return len(b), nil
@@ -188,14 +357,57 @@ func (lw *logWriter) Flush() {
 	}
 }
 
+// serviceSubcommands are the winsvcwrap-management verbs handled by
+// serviceCommand rather than being passed through to service.Main.
+var serviceSubcommands = map[string]bool{
+	"install":            true,
+	"uninstall":          true,
+	"start":              true,
+	"stop":               true,
+	"install-eventlog":   true,
+	"uninstall-eventlog": true,
+}
+
 func main() {
+	var cmd string
+	if len(os.Args) > 1 && serviceSubcommands[os.Args[1]] {
+		cmd = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	cfg := &Config{}
 	config := easyconfig.Configurator{
 		ProgramName: "winsvcwrap",
 	}
 	config.ParseFatal(cfg)
+
+	if cmd != "" {
+		err := serviceCommand(cmd, cfg)
+		if err != nil {
+			log.Fatale(err, "service command failed")
+		}
+		return
+	}
+
 	dexlogconfig.Init()
 
+	// When actually running under the SCM (as opposed to being run
+	// interactively for debugging), bypass service.v2's generic Windows
+	// handler and drive svc.Run ourselves via winSvcHandler, so we can keep
+	// the SCM informed of shutdown progress (see svchandler.go). Fall back
+	// to service.v2 in every other case.
+	interactive, err := svc.IsAnInteractiveSession()
+	if err == nil && !interactive {
+		sup, err := New(cfg)
+		if err != nil {
+			log.Fatale(err, "failed to instantiate supervisor")
+		}
+		if err := svc.Run(serviceName(cfg), &winSvcHandler{sup: sup}); err != nil {
+			log.Fatale(err, "service failed")
+		}
+		return
+	}
+
 	service.Main(&service.Info{
 		Name:          "winsvcwrap",
 		Description:   "Windows service hosting adapter",
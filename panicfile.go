@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const panicFileName = "panic.log"
+
+// panicLogDir resolves the directory rotating panic logs are written to,
+// defaulting to %ProgramData%\winsvcwrap\<service name>.
+func panicLogDir(cfg *Config) string {
+	if cfg.PanicLogDir != "" {
+		return cfg.PanicLogDir
+	}
+	base := os.Getenv("ProgramData")
+	if base == "" {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "winsvcwrap", serviceName(cfg))
+}
+
+// openPanicFile creates (or reopens) the current panic log file and
+// redirects the wrapper's own stderr to it via SetStdHandle, so that a Go
+// runtime panic in winsvcwrap itself is preserved for post-mortem, in
+// addition to the supervised child's teed stderr. It is called from spawn,
+// so the redirection only takes effect once the supervisor starts the
+// child with CaptureStdErr enabled, after service.Main (or svc.Run) has
+// taken over; a panic before that point still goes to the original stderr.
+func openPanicFile(cfg *Config) (*os.File, error) {
+	dir := panicLogDir(cfg)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, panicFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := windows.SetStdHandle(windows.STD_ERROR_HANDLE, windows.Handle(f.Fd())); err != nil {
+		f.Close()
+		return nil, err
+	}
+	os.Stderr = f
+
+	return f, nil
+}
+
+// rotatePanicFile renames the current panic log with a timestamp suffix
+// and prunes old rotations beyond cfg.PanicLogKeep, mirroring the
+// panicFile rotation dockerd's Windows service host performs after the
+// supervised process crashes.
+func rotatePanicFile(cfg *Config) error {
+	dir := panicLogDir(cfg)
+	path := filepath.Join(dir, panicFileName)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	rotated := filepath.Join(dir, fmt.Sprintf("panic-%s.log", time.Now().Format("20060102-150405")))
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+
+	return prunePanicFiles(cfg, dir)
+}
+
+func prunePanicFiles(cfg *Config, dir string) error {
+	keep := cfg.PanicLogKeep
+	if keep <= 0 {
+		keep = 10
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "panic-*.log"))
+	if err != nil {
+		return err
+	}
+	if len(matches) <= keep {
+		return nil
+	}
+
+	sort.Strings(matches) // timestamp suffix sorts chronologically
+	for _, old := range matches[:len(matches)-keep] {
+		if err := os.Remove(old); err != nil {
+			log.Errore(err, "failed to remove old panic log "+old)
+		}
+	}
+
+	return nil
+}
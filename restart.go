@@ -0,0 +1,61 @@
+package main
+
+import "time"
+
+// shouldRestart reports whether cfg.RestartPolicy calls for an in-process
+// restart given the supervised process's exit error (nil on a clean exit).
+func shouldRestart(cfg *Config, exitErr error) bool {
+	switch cfg.RestartPolicy {
+	case "always":
+		return true
+	case "on-failure":
+		return exitErr != nil
+	default: // "never", or unrecognised
+		return false
+	}
+}
+
+// restartsExhausted reports whether the supervisor has already made
+// cfg.MaxRestarts restart attempts (a negative MaxRestarts means
+// unlimited restarts). restartCount is the count before the attempt about
+// to be made is counted.
+func restartsExhausted(cfg *Config, restartCount int) bool {
+	return cfg.MaxRestarts >= 0 && restartCount >= cfg.MaxRestarts
+}
+
+// nextBackoff advances and returns the supervisor's restart backoff. It
+// resets to RestartBackoffInitial if the process had been up for at least
+// HealthySince since it was last spawned, and otherwise doubles the
+// previous backoff up to RestartBackoffMax.
+func (sup *Supervisor) nextBackoff() time.Duration {
+	initial := sup.cfg.RestartBackoffInitial
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := sup.cfg.RestartBackoffMax
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	healthySince := sup.cfg.HealthySince
+	if healthySince <= 0 {
+		healthySince = 60 * time.Second
+	}
+
+	if !sup.lastSpawnAt.IsZero() && time.Since(sup.lastSpawnAt) >= healthySince {
+		sup.restartCount = 0
+		sup.currentBackoff = 0
+	}
+
+	sup.restartCount++
+
+	if sup.currentBackoff <= 0 {
+		sup.currentBackoff = initial
+	} else {
+		sup.currentBackoff *= 2
+		if sup.currentBackoff > max {
+			sup.currentBackoff = max
+		}
+	}
+
+	return sup.currentBackoff
+}
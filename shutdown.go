@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// newChildSysProcAttr returns the SysProcAttr used to start the
+// supervised process. CREATE_NEW_PROCESS_GROUP is required so that a
+// ctrl-break/ctrl-c console control event can be targeted at the child
+// alone via GenerateConsoleCtrlEvent, rather than also reaching
+// winsvcwrap itself.
+func newChildSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// sendStopSignal delivers cfg.StopSignal to the supervised process as a
+// graceful shutdown request. ctrl-break, ctrl-c and wm-close are all
+// delivered as CTRL_BREAK_EVENT via GenerateConsoleCtrlEvent against the
+// child's process group (see newChildSysProcAttr): Windows only honors
+// CTRL_C_EVENT for process group ID 0 (the caller's own group), and
+// GenerateConsoleCtrlEvent with a non-zero group ID returns
+// ERROR_INVALID_PARAMETER for it, so a real Ctrl+C cannot be targeted at a
+// child in its own process group this way. wm-close is likewise
+// approximated, since winsvcwrap has no handle to the child's top-level
+// windows from here. kill skips straight to a hard kill.
+func sendStopSignal(sup *Supervisor) error {
+	switch sup.cfg.StopSignal {
+	case "", "ctrl-break", "ctrl-c", "wm-close":
+		return generateConsoleCtrlEvent(sup, windows.CTRL_BREAK_EVENT)
+	case "kill":
+		return sup.cmd.Process.Kill()
+	default:
+		return fmt.Errorf("unknown StopSignal %q", sup.cfg.StopSignal)
+	}
+}
+
+func generateConsoleCtrlEvent(sup *Supervisor, event uint32) error {
+	return windows.GenerateConsoleCtrlEvent(event, uint32(sup.cmd.Process.Pid))
+}
+
+// stopTimeout returns the configured grace period winsvcwrap waits after
+// sendStopSignal before falling back to killing the supervised process.
+func stopTimeout(cfg *Config) time.Duration {
+	if cfg.StopTimeout > 0 {
+		return cfg.StopTimeout
+	}
+	return 30 * time.Second
+}
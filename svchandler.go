@@ -0,0 +1,83 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// winSvcHandler implements svc.Handler directly, bypassing service.v2's
+// generic Windows handler, which reports StopPending to the SCM exactly
+// once on receiving a stop request and never updates it again while
+// waiting for Stop to return. That leaves the SCM free to consider
+// winsvcwrap hung well before StopTimeout elapses. winSvcHandler instead
+// keeps bumping WaitHint/CheckPoint on a ticker for as long as
+// Supervisor.Stop is still waiting on the graceful shutdown of the
+// supervised process.
+type winSvcHandler struct {
+	sup *Supervisor
+}
+
+const winSvcCmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+
+func (h *winSvcHandler) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	if err := h.sup.Start(); err != nil {
+		log.Criticale(err, "failed to start supervisor")
+		return true, 1
+	}
+
+	changes <- svc.Status{State: svc.Running, Accepts: winSvcCmdsAccepted}
+
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+
+		case svc.Stop, svc.Shutdown:
+			return h.stop(changes)
+
+		default:
+			log.Debugf("ignoring unexpected service control request %v", c.Cmd)
+		}
+	}
+
+	return false, 0
+}
+
+// stop reports StopPending to the SCM, incrementing CheckPoint on a
+// ticker well inside StopTimeout for as long as Supervisor.Stop has not
+// returned, so the SCM keeps waiting instead of marking winsvcwrap hung.
+func (h *winSvcHandler) stop(changes chan<- svc.Status) (bool, uint32) {
+	waitHint := stopTimeout(&h.sup.cfg)
+	tick := waitHint / 10
+	if tick < time.Second {
+		tick = time.Second
+	}
+
+	doneChan := make(chan error, 1)
+	go func() {
+		doneChan <- h.sup.Stop()
+	}()
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var checkPoint uint32
+	for {
+		checkPoint++
+		changes <- svc.Status{
+			State:      svc.StopPending,
+			WaitHint:   uint32(waitHint / time.Millisecond),
+			CheckPoint: checkPoint,
+		}
+
+		select {
+		case <-doneChan:
+			changes <- svc.Status{State: svc.Stopped}
+			return false, 0
+		case <-ticker.C:
+		}
+	}
+}